@@ -0,0 +1,446 @@
+package cnabtooci
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cnabio/cnab-go/bundle"
+	"github.com/cnabio/cnab-to-oci/relocation"
+	"github.com/cnabio/cnab-to-oci/remotes"
+	containerdRemotes "github.com/containerd/containerd/remotes"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// ociLayoutVersion is written to the oci-layout file of every archive this
+// package produces, per the OCI Image Layout spec.
+const ociLayoutVersion = "1.0.0"
+
+// ociLayoutFile mirrors the top-level oci-layout marker file.
+type ociLayoutFile struct {
+	ImageLayoutVersion string `json:"imageLayoutVersion"`
+}
+
+// sourceImageAnnotationKey records, on every non-bundle manifest entry in the
+// archive's index.json, the original (pre-relocation) image reference it was
+// saved from, so LoadBundle can rebuild a relocation map keyed the same way
+// cnab-to-oci's own relocation maps are keyed.
+const sourceImageAnnotationKey = "sh.porter.archive.source-image"
+
+// SaveBundle pulls ref and serializes its bundle manifest, its invocation
+// image, every image in its relocation map, and every blob they reference
+// into a self-contained OCI image-layout archive at outPath, so it can be
+// sneakernet-transferred and later restored with LoadBundle.
+func (r *Registry) SaveBundle(ctx context.Context, ref reference.Named, outPath string) error {
+	resolver, err := r.createMirrorAwareResolver(nil)
+	if err != nil {
+		return err
+	}
+
+	_, manifestDesc, err := resolver.Resolve(ctx, ref.String())
+	if err != nil {
+		return errors.Wrapf(err, "unable to resolve %s", ref)
+	}
+
+	bun, reloMap, err := remotes.Pull(ctx, ref, resolver)
+	if err != nil {
+		return errors.Wrapf(err, "unable to pull %s", ref)
+	}
+
+	layoutDir, err := ioutil.TempDir("", "porter-archive")
+	if err != nil {
+		return errors.Wrap(err, "could not create a temporary archive directory")
+	}
+	defer os.RemoveAll(layoutDir)
+
+	blobsDir := filepath.Join(layoutDir, "blobs", string(digest.Canonical))
+	if err := os.MkdirAll(blobsDir, 0700); err != nil {
+		return errors.Wrap(err, "could not create blobs directory")
+	}
+
+	seen := map[digest.Digest]bool{}
+
+	fetcher, err := resolver.Fetcher(ctx, ref.String())
+	if err != nil {
+		return errors.Wrapf(err, "could not create fetcher for %s", ref)
+	}
+	if err := saveBlobRecursively(ctx, fetcher, blobsDir, manifestDesc, seen); err != nil {
+		return errors.Wrapf(err, "could not save %s", ref)
+	}
+	manifestDesc.Annotations = map[string]string{
+		ocispec.AnnotationRefName: ref.String(),
+	}
+
+	manifests := []ocispec.Descriptor{manifestDesc}
+	for originalImage, actualImage := range imagesToArchive(bun, reloMap) {
+		imgDesc, err := saveImageRecursively(ctx, resolver, blobsDir, actualImage, seen)
+		if err != nil {
+			return errors.Wrapf(err, "could not save image %s", actualImage)
+		}
+		if imgDesc.Annotations == nil {
+			imgDesc.Annotations = map[string]string{}
+		}
+		imgDesc.Annotations[sourceImageAnnotationKey] = originalImage
+		manifests = append(manifests, imgDesc)
+	}
+
+	layout := ociLayoutFile{ImageLayoutVersion: ociLayoutVersion}
+	layoutBytes, err := json.Marshal(layout)
+	if err != nil {
+		return errors.Wrap(err, "could not marshal oci-layout")
+	}
+	if err := ioutil.WriteFile(filepath.Join(layoutDir, "oci-layout"), layoutBytes, 0600); err != nil {
+		return errors.Wrap(err, "could not write oci-layout")
+	}
+
+	index := ocispec.Index{
+		Versioned: ocispec.Versioned{SchemaVersion: 2},
+		Manifests: manifests,
+	}
+	indexBytes, err := json.Marshal(index)
+	if err != nil {
+		return errors.Wrap(err, "could not marshal index.json")
+	}
+	if err := ioutil.WriteFile(filepath.Join(layoutDir, "index.json"), indexBytes, 0600); err != nil {
+		return errors.Wrap(err, "could not write index.json")
+	}
+
+	return tarGzDir(layoutDir, outPath)
+}
+
+// imagesToArchive returns every image SaveBundle needs to pull beyond the
+// bundle manifest itself: the invocation image(s) and every image in bun's
+// custom image list, preferring the already-relocated copy in reloMap when
+// one exists since that's what's actually present in the registry.
+func imagesToArchive(bun *bundle.Bundle, reloMap relocation.ImageRelocationMap) map[string]string {
+	images := map[string]string{}
+
+	addImage := func(originalImage string) {
+		if originalImage == "" {
+			return
+		}
+		if relocated, ok := reloMap[originalImage]; ok {
+			images[originalImage] = relocated
+		} else {
+			images[originalImage] = originalImage
+		}
+	}
+
+	for _, img := range bun.InvocationImages {
+		addImage(img.Image)
+	}
+	for _, img := range bun.Images {
+		addImage(img.Image)
+	}
+
+	return images
+}
+
+// saveImageRecursively resolves imageRef and saves its full blob tree into
+// blobsDir, returning the image's own manifest descriptor so it can be
+// listed in index.json.
+func saveImageRecursively(ctx context.Context, resolver containerdRemotes.Resolver, blobsDir, imageRef string, seen map[digest.Digest]bool) (ocispec.Descriptor, error) {
+	_, desc, err := resolver.Resolve(ctx, imageRef)
+	if err != nil {
+		return ocispec.Descriptor{}, errors.Wrapf(err, "unable to resolve %s", imageRef)
+	}
+	fetcher, err := resolver.Fetcher(ctx, imageRef)
+	if err != nil {
+		return ocispec.Descriptor{}, errors.Wrapf(err, "could not create fetcher for %s", imageRef)
+	}
+	if err := saveBlobRecursively(ctx, fetcher, blobsDir, desc, seen); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+// saveBlobRecursively fetches desc's content, writes it into blobsDir keyed
+// by digest, and if it's a manifest or index, recurses into the blobs it
+// references, so that the resulting archive is self-contained.
+func saveBlobRecursively(ctx context.Context, fetcher containerdRemotes.Fetcher, blobsDir string, desc ocispec.Descriptor, seen map[digest.Digest]bool) error {
+	if seen[desc.Digest] {
+		return nil
+	}
+	seen[desc.Digest] = true
+
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return errors.Wrapf(err, "could not fetch %s", desc.Digest)
+	}
+	content, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return errors.Wrapf(err, "could not read %s", desc.Digest)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(blobsDir, desc.Digest.Encoded()), content, 0600); err != nil {
+		return errors.Wrapf(err, "could not write blob %s", desc.Digest)
+	}
+
+	switch desc.MediaType {
+	case ocispec.MediaTypeImageManifest, "application/vnd.docker.distribution.manifest.v2+json":
+		var manifest ocispec.Manifest
+		if err := json.Unmarshal(content, &manifest); err != nil {
+			return errors.Wrapf(err, "could not parse manifest %s", desc.Digest)
+		}
+		children := append([]ocispec.Descriptor{manifest.Config}, manifest.Layers...)
+		for _, child := range children {
+			if err := saveBlobRecursively(ctx, fetcher, blobsDir, child, seen); err != nil {
+				return err
+			}
+		}
+	case ocispec.MediaTypeImageIndex, "application/vnd.docker.distribution.manifest.list.v2+json":
+		var idx ocispec.Index
+		if err := json.Unmarshal(content, &idx); err != nil {
+			return errors.Wrapf(err, "could not parse index %s", desc.Digest)
+		}
+		for _, child := range idx.Manifests {
+			if err := saveBlobRecursively(ctx, fetcher, blobsDir, child, seen); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// LoadBundle restores an OCI image-layout archive produced by SaveBundle from
+// inPath, pushes the bundle manifest and every archived image to destRef's
+// repository, and returns a relocation map pointing each image's original
+// reference at its newly pushed, registry-specific location.
+func (r *Registry) LoadBundle(ctx context.Context, inPath string, destRef reference.Named) (*relocation.ImageRelocationMap, error) {
+	layoutDir, err := ioutil.TempDir("", "porter-archive")
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create a temporary archive directory")
+	}
+	defer os.RemoveAll(layoutDir)
+
+	if err := untarGz(inPath, layoutDir); err != nil {
+		return nil, errors.Wrapf(err, "could not extract archive %s", inPath)
+	}
+
+	indexBytes, err := ioutil.ReadFile(filepath.Join(layoutDir, "index.json"))
+	if err != nil {
+		return nil, errors.Wrap(err, "archive is missing index.json")
+	}
+	var index ocispec.Index
+	if err := json.Unmarshal(indexBytes, &index); err != nil {
+		return nil, errors.Wrap(err, "could not parse index.json")
+	}
+	if len(index.Manifests) == 0 {
+		return nil, errors.New("archive does not contain any manifests")
+	}
+
+	resolver, err := r.createMirrorAwareResolver(nil)
+	if err != nil {
+		return nil, err
+	}
+	pusher, err := resolver.Pusher(ctx, destRef.String())
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not create pusher for %s", destRef)
+	}
+
+	blobsDir := filepath.Join(layoutDir, "blobs", string(digest.Canonical))
+	seen := map[digest.Digest]bool{}
+
+	reloMap := relocation.ImageRelocationMap{}
+	var bundleDesc *ocispec.Descriptor
+	repoRef := repositoryOnly(destRef)
+
+	for i, desc := range index.Manifests {
+		sourceImage, isImage := desc.Annotations[sourceImageAnnotationKey]
+		if !isImage {
+			bundleDesc = &index.Manifests[i]
+			continue
+		}
+
+		if err := pushBlobRecursively(ctx, pusher, blobsDir, desc, seen); err != nil {
+			return nil, errors.Wrapf(err, "could not push image %s", sourceImage)
+		}
+
+		relocated, err := reference.WithDigest(repoRef, desc.Digest)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not build a relocated reference for %s", sourceImage)
+		}
+		reloMap[sourceImage] = relocated.String()
+	}
+
+	if bundleDesc == nil {
+		return nil, errors.New("archive does not contain a bundle manifest")
+	}
+	if err := pushBlobRecursively(ctx, pusher, blobsDir, *bundleDesc, seen); err != nil {
+		return nil, errors.Wrapf(err, "could not push %s", destRef)
+	}
+
+	return &reloMap, nil
+}
+
+// repositoryOnly strips the tag/digest off ref, leaving just
+// domain/repository, so relocated images can be pushed alongside the bundle
+// manifest under the same repository.
+func repositoryOnly(ref reference.Named) reference.Named {
+	return reference.TrimNamed(ref)
+}
+
+func pushBlobRecursively(ctx context.Context, pusher containerdRemotes.Pusher, blobsDir string, desc ocispec.Descriptor, seen map[digest.Digest]bool) error {
+	if seen[desc.Digest] {
+		return nil
+	}
+	seen[desc.Digest] = true
+
+	content, err := ioutil.ReadFile(filepath.Join(blobsDir, desc.Digest.Encoded()))
+	if err != nil {
+		return errors.Wrapf(err, "archive is missing blob %s", desc.Digest)
+	}
+
+	writer, err := pusher.Push(ctx, desc)
+	if err != nil {
+		if isAlreadyExistsError(err) {
+			return descendIntoChildren(ctx, pusher, blobsDir, desc, content, seen)
+		}
+		return errors.Wrapf(err, "could not push blob %s", desc.Digest)
+	}
+	defer writer.Close()
+	if _, err := writer.Write(content); err != nil {
+		return errors.Wrapf(err, "could not write blob %s", desc.Digest)
+	}
+	if err := writer.Commit(ctx, desc.Size, desc.Digest); err != nil {
+		return errors.Wrapf(err, "could not commit blob %s", desc.Digest)
+	}
+
+	return descendIntoChildren(ctx, pusher, blobsDir, desc, content, seen)
+}
+
+func descendIntoChildren(ctx context.Context, pusher containerdRemotes.Pusher, blobsDir string, desc ocispec.Descriptor, content []byte, seen map[digest.Digest]bool) error {
+	switch desc.MediaType {
+	case ocispec.MediaTypeImageManifest, "application/vnd.docker.distribution.manifest.v2+json":
+		var manifest ocispec.Manifest
+		if err := json.Unmarshal(content, &manifest); err != nil {
+			return errors.Wrapf(err, "could not parse manifest %s", desc.Digest)
+		}
+		children := append([]ocispec.Descriptor{manifest.Config}, manifest.Layers...)
+		for _, child := range children {
+			if err := pushBlobRecursively(ctx, pusher, blobsDir, child, seen); err != nil {
+				return err
+			}
+		}
+	case ocispec.MediaTypeImageIndex, "application/vnd.docker.distribution.manifest.list.v2+json":
+		var idx ocispec.Index
+		if err := json.Unmarshal(content, &idx); err != nil {
+			return errors.Wrapf(err, "could not parse index %s", desc.Digest)
+		}
+		for _, child := range idx.Manifests {
+			if err := pushBlobRecursively(ctx, pusher, blobsDir, child, seen); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// isAlreadyExistsError reports whether err indicates the registry already
+// has the blob, which containerd resolvers surface instead of letting us
+// push a duplicate.
+func isAlreadyExistsError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "already exists")
+}
+
+func tarGzDir(srcDir, outPath string) error {
+	f, err := os.Create(outPath)
+	if err != nil {
+		return errors.Wrapf(err, "could not create archive %s", outPath)
+	}
+	defer f.Close()
+
+	gw := gzip.NewWriter(f)
+	defer gw.Close()
+	tw := tar.NewWriter(gw)
+	defer tw.Close()
+
+	return filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		relPath, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = relPath
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write(data)
+		return err
+	})
+}
+
+// isPathWithin reports whether target is destDir itself or a descendant of
+// it, rejecting the "../" escapes a tampered archive could use to write
+// outside the extraction directory.
+func isPathWithin(destDir, target string) bool {
+	rel, err := filepath.Rel(destDir, target)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func untarGz(archivePath, destDir string) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(destDir, hdr.Name)
+		if !isPathWithin(destDir, target) {
+			return errors.Errorf("archive entry %q escapes the destination directory", hdr.Name)
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+			return err
+		}
+		buf := new(bytes.Buffer)
+		if _, err := io.Copy(buf, tr); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(target, buf.Bytes(), 0600); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package cnabtooci
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTarGzDir_RoundTrip(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "porter-archive-test-src")
+	require.NoError(t, err)
+	defer os.RemoveAll(srcDir)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(srcDir, "blobs", "sha256"), 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(srcDir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(srcDir, "blobs", "sha256", "deadbeef"), []byte("hello"), 0600))
+
+	archivePath := filepath.Join(srcDir, "..", "archive.tar.gz")
+	defer os.Remove(archivePath)
+	require.NoError(t, tarGzDir(srcDir, archivePath))
+
+	destDir, err := ioutil.TempDir("", "porter-archive-test-dest")
+	require.NoError(t, err)
+	defer os.RemoveAll(destDir)
+
+	require.NoError(t, untarGz(archivePath, destDir))
+
+	content, err := ioutil.ReadFile(filepath.Join(destDir, "blobs", "sha256", "deadbeef"))
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(content))
+
+	layout, err := ioutil.ReadFile(filepath.Join(destDir, "oci-layout"))
+	require.NoError(t, err)
+	require.JSONEq(t, `{"imageLayoutVersion":"1.0.0"}`, string(layout))
+}
+
+func TestUntarGz_RejectsPathTraversal(t *testing.T) {
+	archivePath, err := ioutil.TempFile("", "porter-archive-test-*.tar.gz")
+	require.NoError(t, err)
+	defer os.Remove(archivePath.Name())
+
+	gw := gzip.NewWriter(archivePath)
+	tw := tar.NewWriter(gw)
+	evil := "../../etc/evil"
+	require.NoError(t, tw.WriteHeader(&tar.Header{
+		Name: evil,
+		Mode: 0600,
+		Size: int64(len("pwned")),
+	}))
+	_, err = tw.Write([]byte("pwned"))
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+	require.NoError(t, archivePath.Close())
+
+	destDir, err := ioutil.TempDir("", "porter-archive-test-dest")
+	require.NoError(t, err)
+	defer os.RemoveAll(destDir)
+
+	err = untarGz(archivePath.Name(), destDir)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "escapes the destination directory")
+
+	_, statErr := os.Stat(filepath.Join(destDir, evil))
+	require.True(t, os.IsNotExist(statErr), "path-traversal entry should not have been written outside destDir")
+}
+
+func TestIsPathWithin(t *testing.T) {
+	require.True(t, isPathWithin("/tmp/dest", "/tmp/dest/blobs/sha256/abc"))
+	require.True(t, isPathWithin("/tmp/dest", "/tmp/dest"))
+	require.False(t, isPathWithin("/tmp/dest", "/tmp/other"))
+	require.False(t, isPathWithin("/tmp/dest", "/tmp/dest/../escape"))
+}
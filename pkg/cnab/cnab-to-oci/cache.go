@@ -0,0 +1,221 @@
+package cnabtooci
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cnabio/cnab-go/bundle"
+	"github.com/cnabio/cnab-to-oci/relocation"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// PullPolicy controls whether PullBundle goes to the network, and under what
+// circumstances it's allowed to serve a bundle out of the local cache
+// instead, mirroring the pull-policy semantics containers/common added for
+// libimage.
+type PullPolicy string
+
+const (
+	// PullPolicyAlways re-resolves and re-downloads the bundle every time,
+	// the historical porter behavior.
+	PullPolicyAlways PullPolicy = "always"
+
+	// PullPolicyIfNotPresent skips the network round-trip entirely when the
+	// tag is already cached.
+	PullPolicyIfNotPresent PullPolicy = "missing"
+
+	// PullPolicyNever requires the bundle to already be cached, and errors
+	// out otherwise. Useful for airgapped runs.
+	PullPolicyNever PullPolicy = "never"
+
+	// PullPolicyNewer does a HEAD on the manifest and only re-downloads when
+	// the remote digest differs from what's cached.
+	PullPolicyNewer PullPolicy = "newer"
+)
+
+// tagCacheTTL bounds how long a cached tag->digest mapping is trusted before
+// PullPolicyIfNotPresent falls back to resolving the tag again.
+const tagCacheTTL = 24 * time.Hour
+
+// cachedBundleFileName and cachedRelocationMapFileName are the files stored
+// under the content-addressed bundle cache for a single manifest digest.
+const (
+	cachedBundleFileName        = "bundle.json"
+	cachedRelocationMapFileName = "relocation-mapping.json"
+	tagCacheFileName            = "tags.json"
+	bundleCacheDirName          = "cache/bundles"
+	decryptedLayerCacheDirName  = "layers"
+)
+
+// tagCacheEntry records when a tag was last resolved to a digest, so
+// PullPolicyIfNotPresent can use it without re-resolving on every pull.
+type tagCacheEntry struct {
+	Digest   string    `json:"digest"`
+	CachedAt time.Time `json:"cachedAt"`
+}
+
+// bundleCache is a small on-disk content-addressable store for pulled
+// bundles, keyed by their manifest digest, plus a tag->digest index.
+type bundleCache struct {
+	rootDir string
+}
+
+func newBundleCache() (*bundleCache, error) {
+	homeDir, err := porterHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	return &bundleCache{rootDir: filepath.Join(homeDir, bundleCacheDirName)}, nil
+}
+
+func (c *bundleCache) digestDir(d digest.Digest) string {
+	return filepath.Join(c.rootDir, string(d.Algorithm()), d.Encoded())
+}
+
+// decryptedLayerDir is the content-addressed store for plaintext copies of
+// encrypted invocation image layers, keyed by their original (pre-encryption)
+// digest, so that once DecryptKeys successfully unseal a layer there's an
+// actual runnable blob on disk instead of just a validated-but-discarded one.
+func (c *bundleCache) decryptedLayerDir() string {
+	return filepath.Join(filepath.Dir(c.rootDir), decryptedLayerCacheDirName)
+}
+
+// putDecryptedLayer stores the plaintext content of the layer identified by d.
+func (c *bundleCache) putDecryptedLayer(d digest.Digest, content []byte) error {
+	dir := c.decryptedLayerDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Wrap(err, "could not create decrypted layer cache directory")
+	}
+	return ioutil.WriteFile(filepath.Join(dir, d.Encoded()), content, 0600)
+}
+
+// getDecryptedLayer returns the previously-stored plaintext content of the
+// layer identified by d, if present.
+func (c *bundleCache) getDecryptedLayer(d digest.Digest) ([]byte, bool, error) {
+	content, err := ioutil.ReadFile(filepath.Join(c.decryptedLayerDir(), d.Encoded()))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+		return nil, false, errors.Wrap(err, "could not read cached decrypted layer")
+	}
+	return content, true, nil
+}
+
+func (c *bundleCache) tagCachePath() string {
+	return filepath.Join(c.rootDir, tagCacheFileName)
+}
+
+func (c *bundleCache) loadTagCache() (map[string]tagCacheEntry, error) {
+	entries := map[string]tagCacheEntry{}
+	data, err := ioutil.ReadFile(c.tagCachePath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return entries, nil
+		}
+		return nil, errors.Wrap(err, "could not read bundle tag cache")
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, errors.Wrap(err, "could not parse bundle tag cache")
+	}
+	return entries, nil
+}
+
+// resolvedDigest returns the digest tag was last resolved to, if cached and
+// still within the TTL.
+func (c *bundleCache) resolvedDigest(tag string) (digest.Digest, bool, error) {
+	entries, err := c.loadTagCache()
+	if err != nil {
+		return "", false, err
+	}
+	entry, ok := entries[tag]
+	if !ok {
+		return "", false, nil
+	}
+	if time.Since(entry.CachedAt) > tagCacheTTL {
+		return "", false, nil
+	}
+	return digest.Digest(entry.Digest), true, nil
+}
+
+func (c *bundleCache) recordTag(tag string, d digest.Digest) error {
+	if err := os.MkdirAll(c.rootDir, 0700); err != nil {
+		return errors.Wrap(err, "could not create bundle cache directory")
+	}
+	entries, err := c.loadTagCache()
+	if err != nil {
+		return err
+	}
+	entries[tag] = tagCacheEntry{Digest: d.String(), CachedAt: time.Now()}
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return errors.Wrap(err, "could not marshal bundle tag cache")
+	}
+	return ioutil.WriteFile(c.tagCachePath(), data, 0600)
+}
+
+// get returns the cached bundle and relocation map for d, if present.
+func (c *bundleCache) get(d digest.Digest) (bundle.Bundle, *relocation.ImageRelocationMap, bool, error) {
+	dir := c.digestDir(d)
+
+	bunData, err := ioutil.ReadFile(filepath.Join(dir, cachedBundleFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return bundle.Bundle{}, nil, false, nil
+		}
+		return bundle.Bundle{}, nil, false, errors.Wrap(err, "could not read cached bundle")
+	}
+
+	var bun bundle.Bundle
+	if err := json.Unmarshal(bunData, &bun); err != nil {
+		return bundle.Bundle{}, nil, false, errors.Wrap(err, "could not parse cached bundle")
+	}
+
+	var reloMap *relocation.ImageRelocationMap
+	reloData, err := ioutil.ReadFile(filepath.Join(dir, cachedRelocationMapFileName))
+	if err == nil {
+		m := relocation.ImageRelocationMap{}
+		if err := json.Unmarshal(reloData, &m); err != nil {
+			return bundle.Bundle{}, nil, false, errors.Wrap(err, "could not parse cached relocation mapping")
+		}
+		reloMap = &m
+	} else if !os.IsNotExist(err) {
+		return bundle.Bundle{}, nil, false, errors.Wrap(err, "could not read cached relocation mapping")
+	}
+
+	return bun, reloMap, true, nil
+}
+
+// put stores bun and, if present, reloMap under d's content-addressed
+// directory.
+func (c *bundleCache) put(d digest.Digest, bun bundle.Bundle, reloMap *relocation.ImageRelocationMap) error {
+	dir := c.digestDir(d)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Wrap(err, "could not create bundle cache directory")
+	}
+
+	bunData, err := json.Marshal(bun)
+	if err != nil {
+		return errors.Wrap(err, "could not marshal bundle")
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, cachedBundleFileName), bunData, 0600); err != nil {
+		return errors.Wrap(err, "could not write cached bundle")
+	}
+
+	if reloMap != nil {
+		reloData, err := json.Marshal(reloMap)
+		if err != nil {
+			return errors.Wrap(err, "could not marshal relocation mapping")
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, cachedRelocationMapFileName), reloData, 0600); err != nil {
+			return errors.Wrap(err, "could not write cached relocation mapping")
+		}
+	}
+
+	return nil
+}
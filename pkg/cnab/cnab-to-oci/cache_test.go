@@ -0,0 +1,86 @@
+package cnabtooci
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/cnabio/cnab-go/bundle"
+	"github.com/cnabio/cnab-to-oci/relocation"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPullPolicyIfNotPresent_WireValue(t *testing.T) {
+	// Matches the docker/podman --pull convention ("missing"), so a flag
+	// value passed straight through from the CLI is recognized.
+	require.EqualValues(t, "missing", PullPolicyIfNotPresent)
+}
+
+func newTestBundleCache(t *testing.T) *bundleCache {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "porter-cache-test")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return &bundleCache{rootDir: dir}
+}
+
+func TestBundleCache_PutGetRoundTrip(t *testing.T) {
+	c := newTestBundleCache(t)
+
+	bun := bundle.Bundle{Name: "mybuns", Version: "v0.1.1"}
+	reloMap := &relocation.ImageRelocationMap{"original:v1": "relocated:v1"}
+	d := digest.FromString("mybuns")
+
+	require.NoError(t, c.put(d, bun, reloMap))
+
+	gotBun, gotReloMap, ok, err := c.get(d)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, bun, gotBun)
+	require.Equal(t, reloMap, gotReloMap)
+}
+
+func TestBundleCache_GetMissing(t *testing.T) {
+	c := newTestBundleCache(t)
+
+	_, _, ok, err := c.get(digest.FromString("not-cached"))
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestBundleCache_RecordAndResolveTag(t *testing.T) {
+	c := newTestBundleCache(t)
+	d := digest.FromString("mybuns")
+
+	require.NoError(t, c.recordTag("registry.example.com/mybuns:v0.1.1", d))
+
+	resolved, ok, err := c.resolvedDigest("registry.example.com/mybuns:v0.1.1")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, d, resolved)
+
+	_, ok, err = c.resolvedDigest("registry.example.com/other:v0.1.1")
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestBundleCache_DecryptedLayerPutGetRoundTrip(t *testing.T) {
+	c := newTestBundleCache(t)
+	d := digest.FromString("plaintext layer contents")
+
+	require.NoError(t, c.putDecryptedLayer(d, []byte("plaintext layer contents")))
+
+	content, ok, err := c.getDecryptedLayer(d)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, []byte("plaintext layer contents"), content)
+}
+
+func TestBundleCache_DecryptedLayerGetMissing(t *testing.T) {
+	c := newTestBundleCache(t)
+
+	_, ok, err := c.getDecryptedLayer(digest.FromString("never-cached"))
+	require.NoError(t, err)
+	require.False(t, ok)
+}
@@ -0,0 +1,358 @@
+package cnabtooci
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/cnabio/cnab-go/bundle"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// encryptedLayerSuffix is appended to a layer's plain media type once it has
+// been wrapped per the OCI image-spec encryption extension, e.g.
+// "application/vnd.oci.image.layer.v1.tar+gzip" becomes
+// "application/vnd.oci.image.layer.v1.tar+gzip+encrypted".
+const encryptedLayerSuffix = "+encrypted"
+
+// encKeyAnnotationPrefix namespaces the per-recipient sealed symmetric keys
+// recorded on an encrypted layer's descriptor.
+const encKeyAnnotationPrefix = "org.opencontainers.image.enc.keys."
+
+// encryptedImagesCustomKey records, in bundle.json's custom extensions,
+// which images in the bundle have encrypted layers, so `porter inspect` can
+// surface it without having to re-resolve every image.
+const encryptedImagesCustomKey = "sh.porter.encrypted-images"
+
+// EncryptionOptions configures layer encryption for PushInvocationImage and
+// decryption for PullBundle.
+type EncryptionOptions struct {
+	// EncryptRecipients are PEM-encoded RSA public keys (one per file path)
+	// that each layer's symmetric key is sealed to on push.
+	EncryptRecipients []string
+
+	// DecryptKeys are PEM-encoded RSA private keys (one per file path) tried,
+	// in order, to unseal a layer's symmetric key on pull.
+	DecryptKeys []string
+
+	// LayerSelector decides whether a given layer should be encrypted.
+	// Defaults to encrypting every layer when nil.
+	LayerSelector func(desc ocispec.Descriptor) bool
+}
+
+func (o EncryptionOptions) selectsLayer(desc ocispec.Descriptor) bool {
+	if o.LayerSelector == nil {
+		return true
+	}
+	return o.LayerSelector(desc)
+}
+
+// isEncryptedMediaType reports whether mediaType identifies a layer that's
+// been wrapped per the OCI image-spec encryption extension.
+func isEncryptedMediaType(mediaType string) bool {
+	return len(mediaType) > len(encryptedLayerSuffix) && mediaType[len(mediaType)-len(encryptedLayerSuffix):] == encryptedLayerSuffix
+}
+
+// encryptLayer seals content behind a random AES-256-GCM key, and seals that
+// key to each recipient with RSA-OAEP, recording one sealed copy per
+// recipient in the returned annotations map, for the caller to set on the
+// layer's descriptor so that any configured DecryptKeys can unseal it on pull.
+func encryptLayer(content []byte, recipients []string) ([]byte, map[string]string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, errors.Wrap(err, "could not generate a layer encryption key")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not initialize the layer cipher")
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not initialize the layer cipher")
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, errors.Wrap(err, "could not generate a layer nonce")
+	}
+	ciphertext := gcm.Seal(nonce, nonce, content, nil)
+
+	annotations := map[string]string{}
+	for i, recipientPath := range recipients {
+		pub, err := loadRSAPublicKey(recipientPath)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "could not load recipient key %s", recipientPath)
+		}
+		sealedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, key, nil)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "could not seal the layer key for recipient %s", recipientPath)
+		}
+		annotations[fmt.Sprintf("%s%d", encKeyAnnotationPrefix, i)] = base64.StdEncoding.EncodeToString(sealedKey)
+	}
+
+	return ciphertext, annotations, nil
+}
+
+// decryptLayer reverses encryptLayer, trying each of decryptKeys in turn
+// against the sealed keys recorded in annotations until one unseals
+// successfully.
+func decryptLayer(ciphertext []byte, annotations map[string]string, decryptKeys []string) ([]byte, error) {
+	for _, keyPath := range decryptKeys {
+		priv, err := loadRSAPrivateKey(keyPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not load decryption key %s", keyPath)
+		}
+		for annoKey, sealed := range annotations {
+			if len(annoKey) <= len(encKeyAnnotationPrefix) || annoKey[:len(encKeyAnnotationPrefix)] != encKeyAnnotationPrefix {
+				continue
+			}
+			sealedKey, err := base64.StdEncoding.DecodeString(sealed)
+			if err != nil {
+				continue
+			}
+			key, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, priv, sealedKey, nil)
+			if err != nil {
+				continue
+			}
+			block, err := aes.NewCipher(key)
+			if err != nil {
+				continue
+			}
+			gcm, err := cipher.NewGCM(block)
+			if err != nil {
+				continue
+			}
+			if len(ciphertext) < gcm.NonceSize() {
+				continue
+			}
+			nonce, encrypted := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+			plaintext, err := gcm.Open(nil, nonce, encrypted, nil)
+			if err != nil {
+				continue
+			}
+			return plaintext, nil
+		}
+	}
+	return nil, errors.New("none of the supplied decryption keys could unseal this layer")
+}
+
+// encryptManifestLayers fetches each of manifest's layers matching
+// opts.LayerSelector, encrypts them, and returns an updated manifest whose
+// layer descriptors point at the encrypted blobs. The caller is responsible
+// for pushing the returned blobs and manifest.
+func encryptManifestLayers(ctx context.Context, fetch func(ctx context.Context, desc ocispec.Descriptor) ([]byte, error), manifest ocispec.Manifest, opts EncryptionOptions) (ocispec.Manifest, map[digest.Digest][]byte, error) {
+	blobs := map[digest.Digest][]byte{}
+	newLayers := make([]ocispec.Descriptor, len(manifest.Layers))
+
+	for i, layer := range manifest.Layers {
+		if !opts.selectsLayer(layer) || isEncryptedMediaType(layer.MediaType) {
+			newLayers[i] = layer
+			continue
+		}
+
+		content, err := fetch(ctx, layer)
+		if err != nil {
+			return manifest, nil, errors.Wrapf(err, "could not fetch layer %s", layer.Digest)
+		}
+		ciphertext, annotations, err := encryptLayer(content, opts.EncryptRecipients)
+		if err != nil {
+			return manifest, nil, errors.Wrapf(err, "could not encrypt layer %s", layer.Digest)
+		}
+
+		encrypted := layer
+		encrypted.MediaType = layer.MediaType + encryptedLayerSuffix
+		encrypted.Digest = digest.FromBytes(ciphertext)
+		encrypted.Size = int64(len(ciphertext))
+		if encrypted.Annotations == nil {
+			encrypted.Annotations = map[string]string{}
+		}
+		for k, v := range annotations {
+			encrypted.Annotations[k] = v
+		}
+
+		blobs[encrypted.Digest] = ciphertext
+		newLayers[i] = encrypted
+	}
+
+	manifest.Layers = newLayers
+	return manifest, blobs, nil
+}
+
+// decryptManifestLayers fetches each encrypted layer in manifest and
+// decrypts it using opts.DecryptKeys, returning the plaintext blobs
+// keyed by their original (pre-encryption) digest so the runtime can be
+// handed the content it expects.
+func decryptManifestLayers(ctx context.Context, fetch func(ctx context.Context, desc ocispec.Descriptor) ([]byte, error), manifest ocispec.Manifest, opts EncryptionOptions) (map[digest.Digest][]byte, error) {
+	plaintext := map[digest.Digest][]byte{}
+	for _, layer := range manifest.Layers {
+		if !isEncryptedMediaType(layer.MediaType) {
+			continue
+		}
+		ciphertext, err := fetch(ctx, layer)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not fetch encrypted layer %s", layer.Digest)
+		}
+		content, err := decryptLayer(ciphertext, layer.Annotations, opts.DecryptKeys)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not decrypt layer %s", layer.Digest)
+		}
+		plaintext[digest.FromBytes(content)] = content
+	}
+	return plaintext, nil
+}
+
+// recordEncryptedImage marks imageName as encrypted in bun.Custom so that
+// `porter inspect` can display it without re-resolving the manifest.
+func recordEncryptedImage(custom map[string]interface{}, imageName string) map[string]interface{} {
+	if custom == nil {
+		custom = map[string]interface{}{}
+	}
+	var images []string
+	if raw, ok := custom[encryptedImagesCustomKey]; ok {
+		if existing, ok := raw.([]string); ok {
+			images = existing
+		} else if rawSlice, ok := raw.([]interface{}); ok {
+			for _, v := range rawSlice {
+				if s, ok := v.(string); ok {
+					images = append(images, s)
+				}
+			}
+		}
+	}
+	for _, existing := range images {
+		if existing == imageName {
+			return custom
+		}
+	}
+	images = append(images, imageName)
+	custom[encryptedImagesCustomKey] = images
+	return custom
+}
+
+// detectEncryptedImages resolves each of bun's invocation images, records any
+// that have encrypted layers in bun.Custom, and, when encOpts.DecryptKeys are
+// supplied, decrypts those layers and stores the plaintext in the local
+// decrypted-layer cache so that a missing key is surfaced as a pull error
+// rather than a confusing failure later on when the runtime tries to start
+// the container, and so the runtime has a runnable blob to use once the key
+// does unseal it.
+func (r *Registry) detectEncryptedImages(ctx context.Context, bun *bundle.Bundle, encOpts EncryptionOptions) error {
+	resolver, err := r.createMirrorAwareResolver(nil)
+	if err != nil {
+		return err
+	}
+
+	var cache *bundleCache
+	if len(encOpts.DecryptKeys) > 0 {
+		cache, err = newBundleCache()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, img := range bun.InvocationImages {
+		ref, err := ParseOCIReference(img.Image)
+		if err != nil {
+			continue
+		}
+		_, desc, err := resolver.Resolve(ctx, ref.String())
+		if err != nil {
+			return errors.Wrapf(err, "could not resolve invocation image %s", img.Image)
+		}
+		fetcher, err := resolver.Fetcher(ctx, ref.String())
+		if err != nil {
+			return errors.Wrapf(err, "could not fetch invocation image %s", img.Image)
+		}
+		rc, err := fetcher.Fetch(ctx, desc)
+		if err != nil {
+			return errors.Wrapf(err, "could not fetch invocation image %s", img.Image)
+		}
+		manifestBytes, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return errors.Wrapf(err, "could not read the manifest for invocation image %s", img.Image)
+		}
+		var manifest ocispec.Manifest
+		if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+			return errors.Wrapf(err, "could not parse the manifest for invocation image %s", img.Image)
+		}
+
+		encrypted := false
+		for _, layer := range manifest.Layers {
+			if isEncryptedMediaType(layer.MediaType) {
+				encrypted = true
+				break
+			}
+		}
+		if !encrypted {
+			continue
+		}
+
+		bun.Custom = recordEncryptedImage(bun.Custom, img.Image)
+
+		if len(encOpts.DecryptKeys) > 0 {
+			fetchLayer := func(ctx context.Context, layerDesc ocispec.Descriptor) ([]byte, error) {
+				rc, err := fetcher.Fetch(ctx, layerDesc)
+				if err != nil {
+					return nil, err
+				}
+				defer rc.Close()
+				return ioutil.ReadAll(rc)
+			}
+			plaintext, err := decryptManifestLayers(ctx, fetchLayer, manifest, encOpts)
+			if err != nil {
+				return errors.Wrapf(err, "could not decrypt invocation image %s", img.Image)
+			}
+			for d, content := range plaintext {
+				if err := cache.putDecryptedLayer(d, content); err != nil {
+					return errors.Wrapf(err, "could not cache decrypted layer %s for invocation image %s", d, img.Image)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func loadRSAPublicKey(path string) (*rsa.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("not a PEM-encoded key")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("not an RSA public key")
+	}
+	return rsaPub, nil
+}
+
+func loadRSAPrivateKey(path string) (*rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("not a PEM-encoded key")
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
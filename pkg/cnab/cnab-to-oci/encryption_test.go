@@ -0,0 +1,158 @@
+package cnabtooci
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cnabio/cnab-go/bundle"
+	containerdRemotes "github.com/containerd/containerd/remotes"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeManifestResolver resolves any reference to a fixed manifest descriptor,
+// and serves manifestBytes and layerBlobs (keyed by digest) out of memory,
+// standing in for a real registry in detectEncryptedImages tests.
+type fakeManifestResolver struct {
+	manifestDesc  ocispec.Descriptor
+	manifestBytes []byte
+	layerBlobs    map[digest.Digest][]byte
+}
+
+func (f *fakeManifestResolver) Resolve(ctx context.Context, ref string) (string, ocispec.Descriptor, error) {
+	return ref, f.manifestDesc, nil
+}
+
+func (f *fakeManifestResolver) Fetcher(ctx context.Context, ref string) (containerdRemotes.Fetcher, error) {
+	return f, nil
+}
+
+func (f *fakeManifestResolver) Pusher(ctx context.Context, ref string) (containerdRemotes.Pusher, error) {
+	return nil, nil
+}
+
+func (f *fakeManifestResolver) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	if desc.Digest == f.manifestDesc.Digest {
+		return ioutil.NopCloser(bytes.NewReader(f.manifestBytes)), nil
+	}
+	if blob, ok := f.layerBlobs[desc.Digest]; ok {
+		return ioutil.NopCloser(bytes.NewReader(blob)), nil
+	}
+	return nil, os.ErrNotExist
+}
+
+// generateTestRSAKeyPair writes a freshly generated RSA key pair to PEM files
+// under a temporary directory and returns their paths.
+func generateTestRSAKeyPair(t *testing.T) (pubPath, privPath string) {
+	t.Helper()
+
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "porter-encryption-test")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	pubBytes, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	require.NoError(t, err)
+	pubPath = filepath.Join(dir, "recipient.pub")
+	require.NoError(t, ioutil.WriteFile(pubPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubBytes}), 0600))
+
+	privPath = filepath.Join(dir, "recipient.key")
+	require.NoError(t, ioutil.WriteFile(privPath, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)}), 0600))
+
+	return pubPath, privPath
+}
+
+func TestEncryptDecryptLayer_RoundTrip(t *testing.T) {
+	pubPath, privPath := generateTestRSAKeyPair(t)
+
+	content := []byte("this is a layer's plaintext content")
+	ciphertext, annotations, err := encryptLayer(content, []string{pubPath})
+	require.NoError(t, err)
+	require.NotEqual(t, content, ciphertext)
+	require.Len(t, annotations, 1)
+
+	plaintext, err := decryptLayer(ciphertext, annotations, []string{privPath})
+	require.NoError(t, err)
+	require.Equal(t, content, plaintext)
+}
+
+func TestDecryptLayer_WrongKeyFails(t *testing.T) {
+	pubPath, _ := generateTestRSAKeyPair(t)
+	_, wrongPrivPath := generateTestRSAKeyPair(t)
+
+	ciphertext, annotations, err := encryptLayer([]byte("secret"), []string{pubPath})
+	require.NoError(t, err)
+
+	_, err = decryptLayer(ciphertext, annotations, []string{wrongPrivPath})
+	require.Error(t, err)
+}
+
+func TestIsEncryptedMediaType(t *testing.T) {
+	require.True(t, isEncryptedMediaType("application/vnd.oci.image.layer.v1.tar+gzip+encrypted"))
+	require.False(t, isEncryptedMediaType("application/vnd.oci.image.layer.v1.tar+gzip"))
+	require.False(t, isEncryptedMediaType("+encrypted"))
+}
+
+func TestDetectEncryptedImages_DecryptsAndCachesLayers(t *testing.T) {
+	r := newTestRegistry(t)
+
+	pubPath, privPath := generateTestRSAKeyPair(t)
+
+	plainLayer := ocispec.Descriptor{
+		MediaType: "application/vnd.oci.image.layer.v1.tar+gzip",
+		Digest:    digest.FromString("layer contents"),
+		Size:      int64(len("layer contents")),
+	}
+	ciphertext, annotations, err := encryptLayer([]byte("layer contents"), []string{pubPath})
+	require.NoError(t, err)
+	encryptedLayer := plainLayer
+	encryptedLayer.MediaType = plainLayer.MediaType + encryptedLayerSuffix
+	encryptedLayer.Digest = digest.FromBytes(ciphertext)
+	encryptedLayer.Size = int64(len(ciphertext))
+	encryptedLayer.Annotations = annotations
+
+	manifest := ocispec.Manifest{Layers: []ocispec.Descriptor{encryptedLayer}}
+	manifestBytes, err := json.Marshal(manifest)
+	require.NoError(t, err)
+	manifestDesc := ocispec.Descriptor{Digest: digest.FromBytes(manifestBytes), Size: int64(len(manifestBytes))}
+
+	r.newResolver = func(insecureRegistries []string) containerdRemotes.Resolver {
+		return &fakeManifestResolver{
+			manifestDesc:  manifestDesc,
+			manifestBytes: manifestBytes,
+			layerBlobs:    map[digest.Digest][]byte{encryptedLayer.Digest: ciphertext},
+		}
+	}
+
+	bun := &bundle.Bundle{
+		InvocationImages: []bundle.InvocationImage{
+			{BaseImage: bundle.BaseImage{Image: "registry.example.com/mybuns/installer"}},
+		},
+	}
+
+	require.NoError(t, r.detectEncryptedImages(context.Background(), bun, EncryptionOptions{
+		DecryptKeys: []string{privPath},
+	}))
+
+	require.Contains(t, bun.Custom, encryptedImagesCustomKey)
+
+	cache, err := newBundleCache()
+	require.NoError(t, err)
+	content, ok, err := cache.getDecryptedLayer(plainLayer.Digest)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, []byte("layer contents"), content)
+}
@@ -0,0 +1,162 @@
+package cnabtooci
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	containerdRemotes "github.com/containerd/containerd/remotes"
+	"github.com/docker/distribution/reference"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// mirrorAwareResolver tries a reference's configured mirrors, in order,
+// before falling back to its primary registry, mirroring the sysregistriesv2
+// semantics from containers/image. Pulls benefit from mirror failover;
+// pushes always go straight to the primary, since a mirror isn't writable by
+// definition.
+type mirrorAwareResolver struct {
+	newBaseResolver func(insecureRegistries []string) containerdRemotes.Resolver
+	cfg             RegistriesConfig
+	insecurePrimary bool
+
+	mu       sync.Mutex
+	resolved map[string]resolvedCandidate
+}
+
+type resolvedCandidate struct {
+	ref      string
+	insecure bool
+}
+
+func newMirrorAwareResolver(newBaseResolver func(insecureRegistries []string) containerdRemotes.Resolver, cfg RegistriesConfig, insecurePrimary bool) *mirrorAwareResolver {
+	return &mirrorAwareResolver{
+		newBaseResolver: newBaseResolver,
+		cfg:             cfg,
+		insecurePrimary: insecurePrimary,
+		resolved:        map[string]resolvedCandidate{},
+	}
+}
+
+// mirrorsFor returns the RegistryConfig configured for domain, if any.
+func (m *mirrorAwareResolver) mirrorsFor(domain string) (RegistryConfig, bool) {
+	for _, reg := range m.cfg.Registries {
+		if reg.Location == domain {
+			return reg, true
+		}
+	}
+	return RegistryConfig{}, false
+}
+
+// candidatesFor builds the ordered list of refs to try for refStr: each
+// configured mirror (skipping non-digest mirrors when mirror-by-digest-only
+// is set and refStr isn't pinned by digest), then refStr itself.
+func (m *mirrorAwareResolver) candidatesFor(refStr string) ([]resolvedCandidate, error) {
+	named, err := reference.ParseNormalizedNamed(refStr)
+	if err != nil {
+		return []resolvedCandidate{{ref: refStr, insecure: m.insecurePrimary}}, nil
+	}
+
+	reg, ok := m.mirrorsFor(reference.Domain(named))
+	if !ok || len(reg.Mirrors) == 0 {
+		return []resolvedCandidate{{ref: refStr, insecure: m.insecurePrimary}}, nil
+	}
+
+	_, byDigest := named.(reference.Canonical)
+
+	var candidates []resolvedCandidate
+	for _, mirror := range reg.Mirrors {
+		if reg.MirrorByDigestOnly && !byDigest {
+			continue
+		}
+		mirrored, err := substituteDomain(named, mirror.Location)
+		if err != nil {
+			continue
+		}
+		candidates = append(candidates, resolvedCandidate{ref: mirrored.String(), insecure: mirror.Insecure})
+	}
+	candidates = append(candidates, resolvedCandidate{ref: refStr, insecure: m.insecurePrimary})
+	return candidates, nil
+}
+
+func substituteDomain(named reference.Named, newDomain string) (reference.Named, error) {
+	mirrored, err := reference.ParseNormalizedNamed(fmt.Sprintf("%s/%s", newDomain, reference.Path(named)))
+	if err != nil {
+		return nil, err
+	}
+	if tagged, ok := named.(reference.Tagged); ok {
+		if mirrored, err = reference.WithTag(mirrored, tagged.Tag()); err != nil {
+			return nil, err
+		}
+	}
+	if canonical, ok := named.(reference.Canonical); ok {
+		return reference.WithDigest(mirrored, canonical.Digest())
+	}
+	return mirrored, nil
+}
+
+// insecureDomainsFor returns the bare domain of candidate.ref as the single-
+// element "insecure registries" list createResolver expects, when
+// candidate.insecure is set, and an empty list otherwise.
+func insecureDomainsFor(candidate resolvedCandidate) []string {
+	if !candidate.insecure {
+		return nil
+	}
+	named, err := reference.ParseNormalizedNamed(candidate.ref)
+	if err != nil {
+		return nil
+	}
+	return []string{reference.Domain(named)}
+}
+
+func (m *mirrorAwareResolver) Resolve(ctx context.Context, refStr string) (string, ocispec.Descriptor, error) {
+	candidates, err := m.candidatesFor(refStr)
+	if err != nil {
+		return "", ocispec.Descriptor{}, err
+	}
+
+	var lastErr error
+	for _, candidate := range candidates {
+		resolver := m.newBaseResolver(insecureDomainsFor(candidate))
+		name, desc, err := resolver.Resolve(ctx, candidate.ref)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		// Record the candidate under both the name Resolve was called with and
+		// the name it returned: per containerd's resolver contract, callers
+		// invoke Fetcher with the *returned* name, which for a mirrored
+		// reference differs from refStr.
+		m.mu.Lock()
+		m.resolved[refStr] = candidate
+		m.resolved[name] = candidate
+		m.mu.Unlock()
+		return name, desc, nil
+	}
+
+	return "", ocispec.Descriptor{}, errors.Wrapf(lastErr, "unable to resolve %s against any configured mirror", refStr)
+}
+
+func (m *mirrorAwareResolver) candidateFor(refStr string) resolvedCandidate {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c, ok := m.resolved[refStr]; ok {
+		return c
+	}
+	return resolvedCandidate{ref: refStr, insecure: m.insecurePrimary}
+}
+
+func (m *mirrorAwareResolver) Fetcher(ctx context.Context, refStr string) (containerdRemotes.Fetcher, error) {
+	candidate := m.candidateFor(refStr)
+	resolver := m.newBaseResolver(insecureDomainsFor(candidate))
+	return resolver.Fetcher(ctx, candidate.ref)
+}
+
+// Pusher always targets the original, non-mirrored reference: a mirror is a
+// read-through cache, not a push destination.
+func (m *mirrorAwareResolver) Pusher(ctx context.Context, refStr string) (containerdRemotes.Pusher, error) {
+	candidate := resolvedCandidate{ref: refStr, insecure: m.insecurePrimary}
+	return m.newBaseResolver(insecureDomainsFor(candidate)).Pusher(ctx, refStr)
+}
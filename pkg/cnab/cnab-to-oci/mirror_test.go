@@ -0,0 +1,127 @@
+package cnabtooci
+
+import (
+	"context"
+	"testing"
+
+	containerdRemotes "github.com/containerd/containerd/remotes"
+	"github.com/docker/distribution/reference"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// echoResolver is a stub containerdRemotes.Resolver that resolves any
+// reference to itself, mimicking a successful registry resolve without
+// touching the network.
+type echoResolver struct{}
+
+func (echoResolver) Resolve(ctx context.Context, ref string) (string, ocispec.Descriptor, error) {
+	return ref, ocispec.Descriptor{}, nil
+}
+
+func (echoResolver) Fetcher(ctx context.Context, ref string) (containerdRemotes.Fetcher, error) {
+	return nil, nil
+}
+
+func (echoResolver) Pusher(ctx context.Context, ref string) (containerdRemotes.Pusher, error) {
+	return nil, nil
+}
+
+func TestCandidatesFor_PrefersMirrorsThenPrimary(t *testing.T) {
+	cfg := RegistriesConfig{
+		Registries: []RegistryConfig{
+			{
+				Location: "docker.io",
+				Mirrors: []MirrorConfig{
+					{Location: "mirror1.example.com", Insecure: true},
+					{Location: "mirror2.example.com"},
+				},
+			},
+		},
+	}
+	m := newMirrorAwareResolver(nil, cfg, false)
+
+	candidates, err := m.candidatesFor("docker.io/library/hello-world:latest")
+	require.NoError(t, err)
+	require.Len(t, candidates, 3)
+	require.Equal(t, "mirror1.example.com/library/hello-world:latest", candidates[0].ref)
+	require.True(t, candidates[0].insecure)
+	require.Equal(t, "mirror2.example.com/library/hello-world:latest", candidates[1].ref)
+	require.False(t, candidates[1].insecure)
+	require.Equal(t, "docker.io/library/hello-world:latest", candidates[2].ref)
+}
+
+func TestCandidatesFor_MirrorByDigestOnlySkipsTaggedRefs(t *testing.T) {
+	cfg := RegistriesConfig{
+		Registries: []RegistryConfig{
+			{
+				Location:           "docker.io",
+				MirrorByDigestOnly: true,
+				Mirrors:            []MirrorConfig{{Location: "mirror1.example.com"}},
+			},
+		},
+	}
+	m := newMirrorAwareResolver(nil, cfg, false)
+
+	candidates, err := m.candidatesFor("docker.io/library/hello-world:latest")
+	require.NoError(t, err)
+	require.Len(t, candidates, 1)
+	require.Equal(t, "docker.io/library/hello-world:latest", candidates[0].ref)
+}
+
+func TestCandidatesFor_NoConfiguredRegistryFallsBackToPrimary(t *testing.T) {
+	m := newMirrorAwareResolver(nil, RegistriesConfig{}, true)
+
+	candidates, err := m.candidatesFor("ghcr.io/getporter/mybuns:v0.1.1")
+	require.NoError(t, err)
+	require.Len(t, candidates, 1)
+	require.Equal(t, "ghcr.io/getporter/mybuns:v0.1.1", candidates[0].ref)
+	require.True(t, candidates[0].insecure)
+}
+
+func TestInsecureDomainsFor(t *testing.T) {
+	secureCandidate := resolvedCandidate{ref: "mirror.example.com/library/hello-world:latest", insecure: false}
+	require.Nil(t, insecureDomainsFor(secureCandidate))
+
+	insecureCandidate := resolvedCandidate{ref: "mirror.example.com/library/hello-world:latest", insecure: true}
+	require.Equal(t, []string{"mirror.example.com"}, insecureDomainsFor(insecureCandidate))
+}
+
+func TestSubstituteDomain(t *testing.T) {
+	named, err := reference.ParseNormalizedNamed("docker.io/library/hello-world:latest")
+	require.NoError(t, err)
+
+	substituted, err := substituteDomain(named, "mirror.example.com")
+	require.NoError(t, err)
+	require.Equal(t, "mirror.example.com/library/hello-world:latest", substituted.String())
+}
+
+func TestMirrorAwareResolver_FetcherUsesTheCandidateResolveFound(t *testing.T) {
+	cfg := RegistriesConfig{
+		Registries: []RegistryConfig{
+			{
+				Location: "docker.io",
+				Mirrors:  []MirrorConfig{{Location: "mirror.example.com", Insecure: true}},
+			},
+		},
+	}
+
+	var insecureRegistriesByCall [][]string
+	newBaseResolver := func(insecureRegistries []string) containerdRemotes.Resolver {
+		insecureRegistriesByCall = append(insecureRegistriesByCall, insecureRegistries)
+		return echoResolver{}
+	}
+
+	m := newMirrorAwareResolver(newBaseResolver, cfg, false)
+
+	name, _, err := m.Resolve(context.Background(), "docker.io/library/hello-world:latest")
+	require.NoError(t, err)
+	require.Equal(t, "mirror.example.com/library/hello-world:latest", name)
+
+	_, err = m.Fetcher(context.Background(), name)
+	require.NoError(t, err)
+
+	require.Len(t, insecureRegistriesByCall, 2)
+	require.Equal(t, []string{"mirror.example.com"}, insecureRegistriesByCall[0], "Resolve should have used the mirror's insecure domain")
+	require.Equal(t, []string{"mirror.example.com"}, insecureRegistriesByCall[1], "Fetcher should use the same candidate Resolve found, keyed by the returned name")
+}
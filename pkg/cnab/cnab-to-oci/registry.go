@@ -2,7 +2,9 @@ package cnabtooci
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 
 	"strings"
 
@@ -18,6 +20,8 @@ import (
 	"github.com/docker/docker/pkg/jsonmessage"
 	"github.com/docker/docker/pkg/term"
 	"github.com/docker/docker/registry"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 
 	portercontext "get.porter.sh/porter/pkg/context"
@@ -37,23 +41,61 @@ var _ RegistryProvider = &Registry{}
 
 type Registry struct {
 	*portercontext.Context
+
+	// newResolver constructs the low-level containerd resolver for a given
+	// set of insecure registries. It defaults to a resolver backed by the
+	// user's docker config, and is swapped out in tests so that the
+	// orchestration methods built on top of it (PullBundle,
+	// verifyBundleSignature, detectEncryptedImages, ...) can be exercised
+	// without a real registry.
+	newResolver func(insecureRegistries []string) containerdRemotes.Resolver
 }
 
 func NewRegistry(c *portercontext.Context) *Registry {
-	return &Registry{
+	r := &Registry{
 		Context: c,
 	}
+	r.newResolver = func(insecureRegistries []string) containerdRemotes.Resolver {
+		return remotes.CreateResolver(dockerconfig.LoadDefaultConfigFile(r.Out), insecureRegistries...)
+	}
+	return r
+}
+
+// PullBundleOptions consolidates PullBundle's optional behavior so that
+// callers can't silently transpose arguments of similar shape as more of
+// them accumulate.
+type PullBundleOptions struct {
+	// InsecureRegistry allows the bundle's registry to be contacted over
+	// plain HTTP or with an unverified TLS certificate.
+	InsecureRegistry bool
+
+	// SignaturePolicy controls whether the pulled bundle must carry a valid
+	// detached signature.
+	SignaturePolicy VerificationPolicy
+
+	// PullPolicy controls whether the pull can be served out of the local
+	// bundle cache instead of going to the network.
+	PullPolicy PullPolicy
+
+	// Encryption configures decryption of any encrypted invocation image
+	// layers found on the pulled bundle's invocation images.
+	Encryption EncryptionOptions
 }
 
 // PullBundle pulls a bundle from an OCI registry. Returns the bundle, and an optional image relocation mapping, if applicable.
-func (r *Registry) PullBundle(tag string, insecureRegistry bool) (bundle.Bundle, *relocation.ImageRelocationMap, error) {
+func (r *Registry) PullBundle(ctx context.Context, tag string, opts PullBundleOptions) (bundle.Bundle, *relocation.ImageRelocationMap, error) {
+	tag, err := r.resolveTag(ctx, tag)
+	if err != nil {
+		return bundle.Bundle{}, nil, err
+	}
+
 	ref, err := reference.ParseNormalizedNamed(tag)
 	if err != nil {
 		return bundle.Bundle{}, nil, errors.Wrap(err, "invalid bundle tag format, expected REGISTRY/name:tag")
 	}
 
 	var insecureRegistries []string
-	if insecureRegistry {
+	if opts.InsecureRegistry {
 		reg := reference.Domain(ref)
 		insecureRegistries = append(insecureRegistries, reg)
 	}
@@ -62,13 +104,62 @@ func (r *Registry) PullBundle(tag string, insecureRegistry bool) (bundle.Bundle,
 		msg := strings.Builder{}
 		msg.WriteString("Pulling bundle ")
 		msg.WriteString(ref.String())
-		if insecureRegistry {
+		if opts.InsecureRegistry {
 			msg.WriteString(" with --insecure-registry")
 		}
 		fmt.Fprintln(r.Err, msg.String())
 	}
 
-	bun, reloMap, err := remotes.Pull(context.Background(), ref, r.createResolver(insecureRegistries))
+	cache, err := newBundleCache()
+	if err != nil {
+		return bundle.Bundle{}, nil, err
+	}
+
+	if opts.PullPolicy == PullPolicyIfNotPresent {
+		if d, ok, err := cache.resolvedDigest(ref.String()); err == nil && ok {
+			if bun, reloMap, ok, err := cache.get(d); err == nil && ok {
+				return bun, reloMap, nil
+			}
+		}
+	}
+
+	// PullPolicyNever must never touch the network: check the local cache by
+	// the tag's last-recorded digest and fail fast if it's not there, rather
+	// than resolving (and potentially hanging on DNS/connect) first.
+	if opts.PullPolicy == PullPolicyNever {
+		// The tag cache TTL is not applied here: a cached bundle stays usable
+		// offline for as long as it's in the cache.
+		tags, err := cache.loadTagCache()
+		if err != nil {
+			return bundle.Bundle{}, nil, err
+		}
+		entry, ok := tags[ref.String()]
+		if !ok {
+			return bundle.Bundle{}, nil, errors.Errorf("%s is not cached and --pull-policy=never prevents resolving it", ref)
+		}
+		if bun, reloMap, ok, err := cache.get(digest.Digest(entry.Digest)); err == nil && ok {
+			return bun, reloMap, nil
+		}
+		return bundle.Bundle{}, nil, errors.Errorf("%s is not cached and --pull-policy=never prevents pulling it", ref)
+	}
+
+	resolver, err := r.createMirrorAwareResolver(insecureRegistries)
+	if err != nil {
+		return bundle.Bundle{}, nil, err
+	}
+
+	_, manifestDesc, err := resolver.Resolve(ctx, ref.String())
+	if err != nil {
+		return bundle.Bundle{}, nil, errors.Wrapf(err, "unable to resolve %s", ref)
+	}
+
+	if opts.PullPolicy == PullPolicyNewer {
+		if bun, reloMap, ok, err := cache.get(manifestDesc.Digest); err == nil && ok {
+			return bun, reloMap, nil
+		}
+	}
+
+	bun, reloMap, err := remotes.Pull(ctx, ref, resolver)
 	if err != nil {
 		return bundle.Bundle{}, nil, errors.Wrap(err, "unable to pull remote bundle")
 	}
@@ -79,13 +170,30 @@ func (r *Registry) PullBundle(tag string, insecureRegistry bool) (bundle.Bundle,
 			NewErrNoContentDigest(invocationImage.Image)
 	}
 
-	if len(reloMap) == 0 {
-		return *bun, nil, nil
+	if err := r.verifyBundleSignature(ctx, ref, manifestDesc.Digest, opts.SignaturePolicy); err != nil {
+		return bundle.Bundle{}, nil, errors.Wrap(err, "bundle signature verification failed")
+	}
+
+	if err := r.detectEncryptedImages(ctx, bun, opts.Encryption); err != nil {
+		return bundle.Bundle{}, nil, errors.Wrap(err, "unable to process encrypted invocation image layers")
+	}
+
+	var result *relocation.ImageRelocationMap
+	if len(reloMap) > 0 {
+		result = &reloMap
 	}
-	return *bun, &reloMap, nil
+
+	if err := cache.put(manifestDesc.Digest, *bun, result); err != nil {
+		return bundle.Bundle{}, nil, errors.Wrap(err, "could not cache pulled bundle")
+	}
+	if err := cache.recordTag(ref.String(), manifestDesc.Digest); err != nil {
+		return bundle.Bundle{}, nil, errors.Wrap(err, "could not record resolved bundle tag")
+	}
+
+	return *bun, result, nil
 }
 
-func (r *Registry) PushBundle(bun bundle.Bundle, tag string, reloMap relocation.ImageRelocationMap, insecureRegistry bool) (*relocation.ImageRelocationMap, error) {
+func (r *Registry) PushBundle(ctx context.Context, bun bundle.Bundle, tag string, reloMap relocation.ImageRelocationMap, insecureRegistry bool) (*relocation.ImageRelocationMap, error) {
 	ref, err := ParseOCIReference(tag) //tag from manifest
 	if err != nil {
 		return nil, errors.Wrap(err, "invalid bundle tag reference. expected value is REGISTRY/bundle:tag")
@@ -102,11 +210,11 @@ func (r *Registry) PushBundle(bun bundle.Bundle, tag string, reloMap relocation.
 	if reloMap == nil {
 		reloMap = make(relocation.ImageRelocationMap)
 	}
-	rm, err := remotes.FixupBundle(context.Background(), &bun, ref, resolver, remotes.WithEventCallback(r.displayEvent), remotes.WithAutoBundleUpdate(), remotes.WithRelocationMap(reloMap))
+	rm, err := remotes.FixupBundle(ctx, &bun, ref, resolver, remotes.WithEventCallback(r.displayEvent), remotes.WithAutoBundleUpdate(), remotes.WithRelocationMap(reloMap))
 	if err != nil {
 		return nil, errors.Wrap(err, "error preparing the bundle with cnab-to-oci before pushing")
 	}
-	d, err := remotes.Push(context.Background(), &bun, rm, ref, resolver, true)
+	d, err := remotes.Push(ctx, &bun, rm, ref, resolver, true)
 	if err != nil {
 		return nil, errors.Wrapf(err, "error pushing the bundle to %s", tag)
 	}
@@ -120,15 +228,15 @@ func (r *Registry) PushBundle(bun bundle.Bundle, tag string, reloMap relocation.
 
 // PushInvocationImage pushes the invocation image from the Docker image cache to the specified location
 // the expected format of the invocationImage is REGISTRY/NAME:TAG.
-// Returns the image digest from the registry.
-func (r *Registry) PushInvocationImage(invocationImage string) (string, error) {
+// Returns the image digest from the registry. When encOpts specifies
+// recipients, the pushed image's layers are additionally encrypted per the
+// OCI image-spec encryption extension and re-pushed under a new digest.
+func (r *Registry) PushInvocationImage(ctx context.Context, invocationImage string, encOpts EncryptionOptions) (string, error) {
 	cli, err := r.getDockerClient()
 	if err != nil {
 		return "", err
 	}
 
-	ctx := context.Background()
-
 	ref, err := ParseOCIReference(invocationImage)
 	if err != nil {
 		return "", err
@@ -170,11 +278,130 @@ func (r *Registry) PushInvocationImage(invocationImage string) (string, error) {
 	if err != nil {
 		return "", errors.Wrap(err, "unable to inspect docker image")
 	}
-	return string(dist.Descriptor.Digest), nil
+	imageDigest := string(dist.Descriptor.Digest)
+
+	if len(encOpts.EncryptRecipients) == 0 {
+		return imageDigest, nil
+	}
+
+	fmt.Fprintln(r.Out, "Encrypting invocation image layers...")
+	imageDigest, err = r.encryptPushedImage(ctx, ref, encOpts)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to encrypt invocation image layers")
+	}
+	return imageDigest, nil
+}
+
+// encryptPushedImage re-fetches ref's manifest, encrypts the layers selected
+// by encOpts, and pushes the encrypted blobs and the updated manifest back
+// to the same reference, returning the new manifest digest.
+func (r *Registry) encryptPushedImage(ctx context.Context, ref reference.Named, encOpts EncryptionOptions) (string, error) {
+	resolver := r.createResolver(nil)
+
+	_, desc, err := resolver.Resolve(ctx, ref.String())
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to resolve %s", ref)
+	}
+	fetcher, err := resolver.Fetcher(ctx, ref.String())
+	if err != nil {
+		return "", errors.Wrapf(err, "could not create fetcher for %s", ref)
+	}
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return "", errors.Wrapf(err, "could not fetch manifest for %s", ref)
+	}
+	manifestBytes, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return "", errors.Wrap(err, "could not read manifest")
+	}
+
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return "", errors.Wrap(err, "could not parse manifest")
+	}
+
+	fetchLayer := func(ctx context.Context, layerDesc ocispec.Descriptor) ([]byte, error) {
+		rc, err := fetcher.Fetch(ctx, layerDesc)
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return ioutil.ReadAll(rc)
+	}
+
+	encryptedManifest, blobs, err := encryptManifestLayers(ctx, fetchLayer, manifest, encOpts)
+	if err != nil {
+		return "", err
+	}
+
+	pusher, err := resolver.Pusher(ctx, ref.String())
+	if err != nil {
+		return "", errors.Wrapf(err, "could not create pusher for %s", ref)
+	}
+	for d, content := range blobs {
+		layerDesc := ocispec.Descriptor{Digest: d, Size: int64(len(content))}
+		writer, err := pusher.Push(ctx, layerDesc)
+		if err != nil {
+			return "", errors.Wrapf(err, "could not push encrypted layer %s", d)
+		}
+		if _, err := writer.Write(content); err != nil {
+			writer.Close()
+			return "", errors.Wrapf(err, "could not write encrypted layer %s", d)
+		}
+		if err := writer.Commit(ctx, layerDesc.Size, layerDesc.Digest); err != nil {
+			writer.Close()
+			return "", errors.Wrapf(err, "could not commit encrypted layer %s", d)
+		}
+		writer.Close()
+	}
+
+	newManifestBytes, err := json.Marshal(encryptedManifest)
+	if err != nil {
+		return "", errors.Wrap(err, "could not marshal encrypted manifest")
+	}
+	newDesc := ocispec.Descriptor{
+		MediaType: desc.MediaType,
+		Digest:    digest.FromBytes(newManifestBytes),
+		Size:      int64(len(newManifestBytes)),
+	}
+	writer, err := pusher.Push(ctx, newDesc)
+	if err != nil {
+		return "", errors.Wrap(err, "could not push encrypted manifest")
+	}
+	defer writer.Close()
+	if _, err := writer.Write(newManifestBytes); err != nil {
+		return "", errors.Wrap(err, "could not write encrypted manifest")
+	}
+	if err := writer.Commit(ctx, newDesc.Size, newDesc.Digest); err != nil {
+		return "", errors.Wrap(err, "could not commit encrypted manifest")
+	}
+
+	return newDesc.Digest.String(), nil
 }
 
 func (r *Registry) createResolver(insecureRegistries []string) containerdRemotes.Resolver {
-	return remotes.CreateResolver(dockerconfig.LoadDefaultConfigFile(r.Out), insecureRegistries...)
+	return r.newResolver(insecureRegistries)
+}
+
+// createMirrorAwareResolver wraps createResolver with mirror failover when
+// registries.conf configures [[registry]] mirrors, and otherwise behaves
+// exactly like createResolver.
+func (r *Registry) createMirrorAwareResolver(insecureRegistries []string) (containerdRemotes.Resolver, error) {
+	homeDir, err := porterHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := loadRegistriesConfig(homeDir)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.Registries) == 0 {
+		return r.createResolver(insecureRegistries), nil
+	}
+
+	insecurePrimary := len(insecureRegistries) > 0
+	return newMirrorAwareResolver(r.createResolver, cfg, insecurePrimary), nil
 }
 
 func (r *Registry) displayEvent(ev remotes.FixupEvent) {
@@ -0,0 +1,77 @@
+package cnabtooci
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/cnabio/cnab-go/bundle"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+
+	portercontext "get.porter.sh/porter/pkg/context"
+)
+
+// newTestRegistry returns a Registry whose PORTER_HOME-derived cache lives
+// under a temporary directory, so tests can seed/inspect the bundle cache
+// without touching the real user home directory or the network.
+func newTestRegistry(t *testing.T) *Registry {
+	t.Helper()
+
+	home, err := ioutil.TempDir("", "porter-registry-test")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(home) })
+
+	oldHome := os.Getenv("HOME")
+	require.NoError(t, os.Setenv("HOME", home))
+	t.Cleanup(func() { os.Setenv("HOME", oldHome) })
+
+	return NewRegistry(portercontext.New())
+}
+
+func TestPullBundle_PullPolicyNever_NotCached(t *testing.T) {
+	r := newTestRegistry(t)
+
+	_, _, err := r.PullBundle(context.Background(), "registry.example.com/mybuns:v0.1.1", PullBundleOptions{
+		PullPolicy: PullPolicyNever,
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "pull-policy=never")
+}
+
+func TestPullBundle_PullPolicyNever_UsesCacheWithoutResolving(t *testing.T) {
+	r := newTestRegistry(t)
+
+	cache, err := newBundleCache()
+	require.NoError(t, err)
+
+	bun := bundle.Bundle{Name: "mybuns", Version: "v0.1.1"}
+	d := digest.FromString("mybuns")
+	require.NoError(t, cache.put(d, bun, nil))
+	require.NoError(t, cache.recordTag("registry.example.com/mybuns:v0.1.1", d))
+
+	gotBun, _, err := r.PullBundle(context.Background(), "registry.example.com/mybuns:v0.1.1", PullBundleOptions{
+		PullPolicy: PullPolicyNever,
+	})
+	require.NoError(t, err)
+	require.Equal(t, bun, gotBun)
+}
+
+func TestPullBundle_PullPolicyIfNotPresent_UsesCacheWithoutResolving(t *testing.T) {
+	r := newTestRegistry(t)
+
+	cache, err := newBundleCache()
+	require.NoError(t, err)
+
+	bun := bundle.Bundle{Name: "mybuns", Version: "v0.1.1"}
+	d := digest.FromString("mybuns")
+	require.NoError(t, cache.put(d, bun, nil))
+	require.NoError(t, cache.recordTag("registry.example.com/mybuns:v0.1.1", d))
+
+	gotBun, _, err := r.PullBundle(context.Background(), "registry.example.com/mybuns:v0.1.1", PullBundleOptions{
+		PullPolicy: PullPolicyIfNotPresent,
+	})
+	require.NoError(t, err)
+	require.Equal(t, bun, gotBun)
+}
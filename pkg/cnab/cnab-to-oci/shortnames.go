@@ -0,0 +1,284 @@
+package cnabtooci
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+)
+
+// ShortNameMode controls how an unqualified bundle reference, e.g. mybuns:v0.1.1,
+// is resolved to a fully-qualified one.
+type ShortNameMode string
+
+const (
+	// ShortNameModePermissive tries each unqualified-search-registries entry in
+	// order and silently uses the first one that resolves.
+	ShortNameModePermissive ShortNameMode = "permissive"
+
+	// ShortNameModeEnforcing behaves like ShortNameModePermissive, but errors
+	// out if the short name resolves against more than one registry and isn't
+	// explicitly aliased.
+	ShortNameModeEnforcing ShortNameMode = "enforcing"
+
+	// ShortNameModeDisabled requires that all bundle references be fully
+	// qualified. This is the default, matching porter's historical behavior.
+	ShortNameModeDisabled ShortNameMode = "disabled"
+)
+
+// registriesConfigFileName is the name of the user-editable config file,
+// stored alongside porter's other configuration in PORTER_HOME.
+const registriesConfigFileName = "registries.conf"
+
+// shortNameAliasesCacheFileName caches the short names that have already been
+// resolved so that repeat pulls are deterministic, mirroring
+// containers-registries.conf's short-name-aliases.conf.
+const shortNameAliasesCacheFileName = "short-name-aliases.conf"
+
+// RegistriesConfig is the schema of ~/.porter/registries.conf, modeled on
+// containers-registries.conf(5).
+type RegistriesConfig struct {
+	Mode ShortNameMode `toml:"short-name-mode"`
+
+	// Aliases maps an exact short name, e.g. "mybuns" or "mybuns:v0.1.1", to
+	// the fully-qualified reference it should resolve to.
+	Aliases map[string]string `toml:"aliases"`
+
+	// UnqualifiedSearchRegistries is the ordered list of registries to try
+	// when resolving a short name that isn't aliased.
+	UnqualifiedSearchRegistries []string `toml:"unqualified-search-registries"`
+
+	// Registries configures mirrors and other per-registry behavior, e.g.
+	// [[registry]] blocks with location = "docker.io" and nested
+	// [[registry.mirror]] entries.
+	Registries []RegistryConfig `toml:"registry"`
+}
+
+// RegistryConfig describes mirror and failover behavior for bundles and
+// referenced images hosted at Location, mirroring sysregistriesv2's
+// [[registry]] table.
+type RegistryConfig struct {
+	// Location is the registry domain this configuration applies to, e.g.
+	// "docker.io".
+	Location string `toml:"location"`
+
+	// MirrorByDigestOnly restricts Mirrors to references pinned by digest,
+	// since a tag isn't guaranteed to mean the same thing at every mirror.
+	MirrorByDigestOnly bool `toml:"mirror-by-digest-only"`
+
+	// Mirrors are tried, in order, before falling back to Location.
+	Mirrors []MirrorConfig `toml:"mirror"`
+}
+
+// MirrorConfig is a single [[registry.mirror]] entry.
+type MirrorConfig struct {
+	Location string `toml:"location"`
+	Insecure bool   `toml:"insecure"`
+}
+
+// defaultRegistriesConfig is used when no registries.conf is present, and
+// preserves today's require-fully-qualified-names behavior.
+func defaultRegistriesConfig() RegistriesConfig {
+	return RegistriesConfig{
+		Mode:    ShortNameModeDisabled,
+		Aliases: map[string]string{},
+	}
+}
+
+// loadRegistriesConfig reads and parses registries.conf from porterHomeDir.
+// A missing file is not an error; it just means short names are disabled.
+func loadRegistriesConfig(porterHomeDir string) (RegistriesConfig, error) {
+	cfg := defaultRegistriesConfig()
+
+	path := filepath.Join(porterHomeDir, registriesConfigFileName)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return cfg, errors.Wrapf(err, "could not read %s", path)
+	}
+
+	if _, err := toml.Decode(string(data), &cfg); err != nil {
+		return cfg, errors.Wrapf(err, "could not parse %s", path)
+	}
+	if cfg.Mode == "" {
+		cfg.Mode = ShortNameModeDisabled
+	}
+	return cfg, nil
+}
+
+// isShortName returns true when name has no registry domain component, e.g.
+// "mybuns:v0.1.1" rather than "ghcr.io/getporter/mybuns:v0.1.1".
+func isShortName(name string) bool {
+	firstSlash := strings.Index(name, "/")
+	if firstSlash == -1 {
+		return true
+	}
+	domainCandidate := name[:firstSlash]
+	return !strings.ContainsAny(domainCandidate, ".:") && domainCandidate != "localhost"
+}
+
+// resolveTag resolves tag to a fully-qualified bundle reference if it is a
+// short name and short-name resolution is enabled in registries.conf.
+// Fully-qualified references are always passed through unchanged, so this is
+// a no-op when the user hasn't opted in to short names.
+func (r *Registry) resolveTag(ctx context.Context, tag string) (string, error) {
+	if !isShortName(tag) {
+		return tag, nil
+	}
+
+	homeDir, err := porterHomeDir()
+	if err != nil {
+		return "", err
+	}
+	cfg, err := loadRegistriesConfig(homeDir)
+	if err != nil {
+		return "", err
+	}
+	if cfg.Mode == ShortNameModeDisabled || cfg.Mode == "" {
+		return tag, nil
+	}
+
+	return r.resolveShortName(ctx, tag, cfg)
+}
+
+// resolveShortName expands an unqualified bundle name into a fully-qualified
+// one according to cfg.Mode, probing each unqualified-search-registries entry
+// against the real registry.
+func (r *Registry) resolveShortName(ctx context.Context, name string, cfg RegistriesConfig) (string, error) {
+	return r.resolveShortNameWithProbe(ctx, name, cfg, func(ctx context.Context, ref string) error {
+		_, _, err := r.createResolver(nil).Resolve(ctx, ref)
+		return err
+	})
+}
+
+// resolveShortNameWithProbe does the work of resolveShortName, consulting
+// aliases first and then the unqualified-search-registries in order, calling
+// probe against each candidate to check whether it exists. The cache records
+// successful resolutions so that later pulls of the same short name don't
+// need to re-probe the search registries. Split out from resolveShortName so
+// that the search/precedence/ambiguity logic can be tested without a real
+// registry.
+func (r *Registry) resolveShortNameWithProbe(ctx context.Context, name string, cfg RegistriesConfig, probe func(ctx context.Context, ref string) error) (string, error) {
+	if !isShortName(name) {
+		return name, nil
+	}
+
+	switch cfg.Mode {
+	case ShortNameModeDisabled, "":
+		return "", errors.Errorf("%q is not a fully-qualified bundle reference, and short-name resolution is disabled", name)
+	case ShortNameModePermissive, ShortNameModeEnforcing:
+		// handled below
+	default:
+		return "", errors.Errorf("unrecognized short-name-mode %q", cfg.Mode)
+	}
+
+	if fqn, ok := cfg.Aliases[name]; ok {
+		return fqn, nil
+	}
+
+	cache, err := r.loadShortNameCache()
+	if err != nil {
+		return "", err
+	}
+	if fqn, ok := cache[name]; ok {
+		return fqn, nil
+	}
+
+	var matches []string
+	for _, search := range cfg.UnqualifiedSearchRegistries {
+		candidate := fmt.Sprintf("%s/%s", strings.TrimSuffix(search, "/"), name)
+		ref, err := ParseOCIReference(candidate)
+		if err != nil {
+			continue
+		}
+		if err := probe(ctx, ref.String()); err != nil {
+			continue
+		}
+		matches = append(matches, candidate)
+		if cfg.Mode == ShortNameModePermissive {
+			break
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", errors.Errorf("could not resolve short name %q against any unqualified-search-registries", name)
+	case 1:
+		if err := r.cacheShortNameResolution(name, matches[0]); err != nil {
+			return "", err
+		}
+		return matches[0], nil
+	default:
+		return "", errors.Errorf("short name %q is ambiguous, it resolves against multiple registries: %s; add an alias to registries.conf to disambiguate", name, strings.Join(matches, ", "))
+	}
+}
+
+// porterHomeDir returns the directory porter stores its configuration in,
+// e.g. ~/.porter.
+func porterHomeDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", errors.Wrap(err, "could not determine the user's home directory")
+	}
+	return filepath.Join(home, ".porter"), nil
+}
+
+func (r *Registry) loadShortNameCache() (map[string]string, error) {
+	homeDir, err := porterHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(homeDir, shortNameAliasesCacheFileName)
+	cache := map[string]string{}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cache, nil
+		}
+		return nil, errors.Wrapf(err, "could not read %s", path)
+	}
+	var file struct {
+		Aliases map[string]string `toml:"aliases"`
+	}
+	if _, err := toml.Decode(string(data), &file); err != nil {
+		return nil, errors.Wrapf(err, "could not parse %s", path)
+	}
+	for name, fqn := range file.Aliases {
+		cache[name] = fqn
+	}
+	return cache, nil
+}
+
+func (r *Registry) cacheShortNameResolution(name, fqn string) error {
+	cache, err := r.loadShortNameCache()
+	if err != nil {
+		return err
+	}
+	cache[name] = fqn
+
+	homeDir, err := porterHomeDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(homeDir, 0700); err != nil {
+		return errors.Wrapf(err, "could not create %s", homeDir)
+	}
+	path := filepath.Join(homeDir, shortNameAliasesCacheFileName)
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.Wrapf(err, "could not write %s", path)
+	}
+	defer f.Close()
+
+	return toml.NewEncoder(f).Encode(struct {
+		Aliases map[string]string `toml:"aliases"`
+	}{cache})
+}
@@ -0,0 +1,124 @@
+package cnabtooci
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// alwaysFoundProbe treats every candidate as resolvable.
+func alwaysFoundProbe(ctx context.Context, ref string) error {
+	return nil
+}
+
+// foundOnlyProbe treats exactly the candidates in found as resolvable, and
+// everything else as a miss.
+func foundOnlyProbe(found ...string) func(ctx context.Context, ref string) error {
+	return func(ctx context.Context, ref string) error {
+		for _, f := range found {
+			if f == ref {
+				return nil
+			}
+		}
+		return errors.New("not found")
+	}
+}
+
+func TestResolveShortNameWithProbe_DisabledModeErrors(t *testing.T) {
+	r := newTestRegistry(t)
+
+	_, err := r.resolveShortNameWithProbe(context.Background(), "mybuns:v0.1.1", RegistriesConfig{Mode: ShortNameModeDisabled}, alwaysFoundProbe)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "short-name resolution is disabled")
+}
+
+func TestResolveShortNameWithProbe_AliasTakesPrecedenceOverSearchRegistries(t *testing.T) {
+	r := newTestRegistry(t)
+
+	cfg := RegistriesConfig{
+		Mode:                        ShortNameModePermissive,
+		Aliases:                     map[string]string{"mybuns:v0.1.1": "aliased.example.com/mybuns:v0.1.1"},
+		UnqualifiedSearchRegistries: []string{"search.example.com"},
+	}
+
+	fqn, err := r.resolveShortNameWithProbe(context.Background(), "mybuns:v0.1.1", cfg, func(ctx context.Context, ref string) error {
+		t.Fatalf("probe should not be called when an alias matches, got ref %q", ref)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, "aliased.example.com/mybuns:v0.1.1", fqn)
+}
+
+func TestResolveShortNameWithProbe_Permissive_FirstMatchWins(t *testing.T) {
+	r := newTestRegistry(t)
+
+	cfg := RegistriesConfig{
+		Mode: ShortNameModePermissive,
+		UnqualifiedSearchRegistries: []string{
+			"search1.example.com",
+			"search2.example.com",
+		},
+	}
+
+	fqn, err := r.resolveShortNameWithProbe(context.Background(), "mybuns:v0.1.1", cfg,
+		foundOnlyProbe("search1.example.com/mybuns:v0.1.1", "search2.example.com/mybuns:v0.1.1"))
+	require.NoError(t, err)
+	require.Equal(t, "search1.example.com/mybuns:v0.1.1", fqn)
+}
+
+func TestResolveShortNameWithProbe_Enforcing_AmbiguousMatchErrors(t *testing.T) {
+	r := newTestRegistry(t)
+
+	cfg := RegistriesConfig{
+		Mode: ShortNameModeEnforcing,
+		UnqualifiedSearchRegistries: []string{
+			"search1.example.com",
+			"search2.example.com",
+		},
+	}
+
+	_, err := r.resolveShortNameWithProbe(context.Background(), "mybuns:v0.1.1", cfg,
+		foundOnlyProbe("search1.example.com/mybuns:v0.1.1", "search2.example.com/mybuns:v0.1.1"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "is ambiguous")
+}
+
+func TestResolveShortNameWithProbe_Enforcing_SingleMatchSucceeds(t *testing.T) {
+	r := newTestRegistry(t)
+
+	cfg := RegistriesConfig{
+		Mode: ShortNameModeEnforcing,
+		UnqualifiedSearchRegistries: []string{
+			"search1.example.com",
+			"search2.example.com",
+		},
+	}
+
+	fqn, err := r.resolveShortNameWithProbe(context.Background(), "mybuns:v0.1.1", cfg,
+		foundOnlyProbe("search2.example.com/mybuns:v0.1.1"))
+	require.NoError(t, err)
+	require.Equal(t, "search2.example.com/mybuns:v0.1.1", fqn)
+}
+
+func TestResolveShortNameWithProbe_NoMatchErrors(t *testing.T) {
+	r := newTestRegistry(t)
+
+	cfg := RegistriesConfig{
+		Mode:                        ShortNameModePermissive,
+		UnqualifiedSearchRegistries: []string{"search.example.com"},
+	}
+
+	_, err := r.resolveShortNameWithProbe(context.Background(), "mybuns:v0.1.1", cfg, foundOnlyProbe())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "could not resolve short name")
+}
+
+func TestResolveShortNameWithProbe_FullyQualifiedNameIsPassthrough(t *testing.T) {
+	r := newTestRegistry(t)
+
+	fqn, err := r.resolveShortNameWithProbe(context.Background(), "registry.example.com/mybuns:v0.1.1", RegistriesConfig{Mode: ShortNameModeDisabled}, alwaysFoundProbe)
+	require.NoError(t, err)
+	require.Equal(t, "registry.example.com/mybuns:v0.1.1", fqn)
+}
@@ -0,0 +1,220 @@
+package cnabtooci
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	containerdRemotes "github.com/containerd/containerd/remotes"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// bundleSignatureMediaType identifies a detached CNAB bundle signature stored
+// as a companion OCI artifact, following the cosign convention of tagging the
+// signature sha256-<digest>.sig alongside the thing it signs.
+const bundleSignatureMediaType = "application/vnd.cnab.bundle.signature.v1+json"
+
+// bundleSignatureType is recorded in the signed payload so that a signature
+// cannot be replayed against a different kind of artifact.
+const bundleSignatureType = "porter bundle signature"
+
+// signaturePayload is the data that gets signed and uploaded alongside a
+// bundle, modeled on cosign's simple signing format.
+type signaturePayload struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+// signedBundle is what gets pushed as the companion signature artifact: the
+// payload plus the signature over it, so a verifier doesn't need a separate
+// fetch.
+type signedBundle struct {
+	Payload   []byte `json:"payload"`
+	Signature []byte `json:"signature"`
+}
+
+// VerificationPolicy controls whether PullBundle requires and checks a
+// detached signature before trusting a pulled bundle.
+type VerificationPolicy struct {
+	// RequireSignature causes PullBundle to fail closed when no signature is
+	// found for the pulled reference.
+	RequireSignature bool
+
+	// TrustedKeys are the ed25519 public keys that a signature must validate
+	// against. In the common case this is populated from a policy.json that
+	// maps repository prefixes to keys; porter only needs the flattened set
+	// of keys that apply to the reference being pulled.
+	TrustedKeys []ed25519.PublicKey
+}
+
+func signatureTagFor(ref reference.Named, manifestDigest digest.Digest) (string, error) {
+	named, err := reference.WithName(reference.Domain(ref) + "/" + reference.Path(ref))
+	if err != nil {
+		return "", err
+	}
+	tagged, err := reference.WithTag(named, fmt.Sprintf("sha256-%s.sig", manifestDigest.Encoded()))
+	if err != nil {
+		return "", err
+	}
+	return tagged.String(), nil
+}
+
+// SignBundle signs the pushed bundle manifest digest with the ed25519 private
+// key stored at keyPath, and uploads the signature as a companion OCI
+// artifact tagged sha256-<digest>.sig in the same repository, so that
+// PullBundle can later verify it.
+func (r *Registry) SignBundle(ctx context.Context, ref reference.Named, manifestDigest digest.Digest, keyPath string) error {
+	keyBytes, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return errors.Wrapf(err, "could not read signing key %s", keyPath)
+	}
+	if len(keyBytes) != ed25519.PrivateKeySize {
+		return errors.Errorf("%s does not contain a valid ed25519 private key", keyPath)
+	}
+	key := ed25519.PrivateKey(keyBytes)
+
+	var payload signaturePayload
+	payload.Critical.Identity.DockerReference = ref.String()
+	payload.Critical.Image.DockerManifestDigest = manifestDigest.String()
+	payload.Critical.Type = bundleSignatureType
+
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return errors.Wrap(err, "could not marshal signature payload")
+	}
+
+	sig := signedBundle{
+		Payload:   payloadBytes,
+		Signature: ed25519.Sign(key, payloadBytes),
+	}
+	sigBytes, err := json.Marshal(sig)
+	if err != nil {
+		return errors.Wrap(err, "could not marshal signature")
+	}
+
+	sigTag, err := signatureTagFor(ref, manifestDigest)
+	if err != nil {
+		return errors.Wrap(err, "could not derive signature tag")
+	}
+	sigRef, err := ParseOCIReference(sigTag)
+	if err != nil {
+		return err
+	}
+
+	desc := ocispec.Descriptor{
+		MediaType: bundleSignatureMediaType,
+		Digest:    digest.FromBytes(sigBytes),
+		Size:      int64(len(sigBytes)),
+	}
+
+	pusher, err := r.createResolver(nil).Pusher(ctx, sigRef.String())
+	if err != nil {
+		return errors.Wrapf(err, "could not create pusher for %s", sigRef)
+	}
+	writer, err := pusher.Push(ctx, desc)
+	if err != nil {
+		return errors.Wrapf(err, "could not push signature to %s", sigRef)
+	}
+	defer writer.Close()
+
+	if _, err := writer.Write(sigBytes); err != nil {
+		return errors.Wrap(err, "could not write signature")
+	}
+	return writer.Commit(ctx, desc.Size, desc.Digest)
+}
+
+// verifyBundleSignature fetches and checks the companion signature for ref at
+// manifestDigest against policy. It returns an error when the policy
+// requires a signature and none is found, or when a found signature doesn't
+// verify.
+func (r *Registry) verifyBundleSignature(ctx context.Context, ref reference.Named, manifestDigest digest.Digest, policy VerificationPolicy) error {
+	sigTag, err := signatureTagFor(ref, manifestDigest)
+	if err != nil {
+		return errors.Wrap(err, "could not derive signature tag")
+	}
+	sigRef, err := ParseOCIReference(sigTag)
+	if err != nil {
+		return err
+	}
+
+	resolver, err := r.createMirrorAwareResolver(nil)
+	if err != nil {
+		return err
+	}
+	_, desc, err := resolver.Resolve(ctx, sigRef.String())
+	if err != nil {
+		if policy.RequireSignature {
+			return errors.Errorf("policy requires a signature for %s, but none was found: %s", ref, err)
+		}
+		return nil
+	}
+
+	sig, err := fetchSignature(ctx, resolver, sigRef.String(), desc)
+	if err != nil {
+		return err
+	}
+
+	var payload signaturePayload
+	if err := json.Unmarshal(sig.Payload, &payload); err != nil {
+		return errors.Wrap(err, "could not parse signature payload")
+	}
+	if payload.Critical.Type != bundleSignatureType {
+		return errors.Errorf("signature for %s has unexpected type %q", ref, payload.Critical.Type)
+	}
+	if payload.Critical.Identity.DockerReference != ref.String() {
+		return errors.Errorf("signature for %s was issued for a different reference %q", ref, payload.Critical.Identity.DockerReference)
+	}
+	if payload.Critical.Image.DockerManifestDigest != manifestDigest.String() {
+		return errors.Errorf("signature for %s does not match the pulled digest %s", ref, manifestDigest)
+	}
+
+	if len(policy.TrustedKeys) == 0 {
+		if policy.RequireSignature {
+			return errors.Errorf("policy requires a signature for %s, but no trusted keys are configured to verify it", ref)
+		}
+		return nil
+	}
+
+	for _, key := range policy.TrustedKeys {
+		if ed25519.Verify(key, sig.Payload, sig.Signature) {
+			return nil
+		}
+	}
+	return errors.Errorf("signature for %s does not match any trusted key", ref)
+}
+
+func fetchSignature(ctx context.Context, resolver containerdRemotes.Resolver, ref string, desc ocispec.Descriptor) (signedBundle, error) {
+	fetcher, err := resolver.Fetcher(ctx, ref)
+	if err != nil {
+		return signedBundle{}, errors.Wrapf(err, "could not create fetcher for %s", ref)
+	}
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return signedBundle{}, errors.Wrapf(err, "could not fetch signature %s", ref)
+	}
+	defer rc.Close()
+
+	buf := new(bytes.Buffer)
+	if _, err := buf.ReadFrom(rc); err != nil {
+		return signedBundle{}, errors.Wrap(err, "could not read signature")
+	}
+
+	var sig signedBundle
+	if err := json.Unmarshal(buf.Bytes(), &sig); err != nil {
+		return signedBundle{}, errors.Wrap(err, "could not parse signature")
+	}
+	return sig, nil
+}
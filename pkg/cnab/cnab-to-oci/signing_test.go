@@ -0,0 +1,197 @@
+package cnabtooci
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	containerdRemotes "github.com/containerd/containerd/remotes"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// notFoundResolver fails every Resolve call, standing in for a registry that
+// has no companion signature artifact.
+type notFoundResolver struct{}
+
+func (notFoundResolver) Resolve(ctx context.Context, ref string) (string, ocispec.Descriptor, error) {
+	return "", ocispec.Descriptor{}, os.ErrNotExist
+}
+
+func (notFoundResolver) Fetcher(ctx context.Context, ref string) (containerdRemotes.Fetcher, error) {
+	return nil, os.ErrNotExist
+}
+
+func (notFoundResolver) Pusher(ctx context.Context, ref string) (containerdRemotes.Pusher, error) {
+	return nil, os.ErrNotExist
+}
+
+// fakeSignatureResolver resolves any reference to desc and serves sigBytes as
+// its content, standing in for a registry that has the companion signature
+// artifact pushed by SignBundle.
+type fakeSignatureResolver struct {
+	desc     ocispec.Descriptor
+	sigBytes []byte
+}
+
+func (f *fakeSignatureResolver) Resolve(ctx context.Context, ref string) (string, ocispec.Descriptor, error) {
+	return ref, f.desc, nil
+}
+
+func (f *fakeSignatureResolver) Fetcher(ctx context.Context, ref string) (containerdRemotes.Fetcher, error) {
+	return f, nil
+}
+
+func (f *fakeSignatureResolver) Pusher(ctx context.Context, ref string) (containerdRemotes.Pusher, error) {
+	return nil, nil
+}
+
+func (f *fakeSignatureResolver) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(f.sigBytes)), nil
+}
+
+func TestSignaturePayload_CosignCompatibleShape(t *testing.T) {
+	var payload signaturePayload
+	payload.Critical.Identity.DockerReference = "registry.example.com/mybuns:v0.1.1"
+	payload.Critical.Image.DockerManifestDigest = "sha256:abc123"
+	payload.Critical.Type = bundleSignatureType
+
+	payloadBytes, err := json.Marshal(payload)
+	require.NoError(t, err)
+
+	var raw map[string]interface{}
+	require.NoError(t, json.Unmarshal(payloadBytes, &raw))
+
+	critical, ok := raw["critical"].(map[string]interface{})
+	require.True(t, ok, "expected a top-level \"critical\" key")
+
+	image, ok := critical["image"].(map[string]interface{})
+	require.True(t, ok, "expected critical.image, the cosign-compatible key")
+	require.Equal(t, "sha256:abc123", image["docker-manifest-digest"])
+
+	var roundTripped signaturePayload
+	require.NoError(t, json.Unmarshal(payloadBytes, &roundTripped))
+	require.Equal(t, payload, roundTripped)
+}
+
+func TestSignatureTagFor_UsesSigSuffix(t *testing.T) {
+	ref, err := reference.ParseNormalizedNamed("registry.example.com/mybuns")
+	require.NoError(t, err)
+
+	tag, err := signatureTagFor(ref, digest.FromString("hello"))
+	require.NoError(t, err)
+	require.Equal(t, "registry.example.com/mybuns:sha256-"+digest.FromString("hello").Encoded()+".sig", tag)
+}
+
+func TestVerifyBundleSignature_FailClosedWhenNoneFound(t *testing.T) {
+	r := newTestRegistry(t)
+	r.newResolver = func(insecureRegistries []string) containerdRemotes.Resolver { return notFoundResolver{} }
+
+	ref, err := reference.ParseNormalizedNamed("registry.example.com/mybuns:v0.1.1")
+	require.NoError(t, err)
+
+	err = r.verifyBundleSignature(context.Background(), ref, digest.FromString("manifest"), VerificationPolicy{RequireSignature: true})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "policy requires a signature")
+}
+
+func TestVerifyBundleSignature_FailOpenWhenNoneFound(t *testing.T) {
+	r := newTestRegistry(t)
+	r.newResolver = func(insecureRegistries []string) containerdRemotes.Resolver { return notFoundResolver{} }
+
+	ref, err := reference.ParseNormalizedNamed("registry.example.com/mybuns:v0.1.1")
+	require.NoError(t, err)
+
+	err = r.verifyBundleSignature(context.Background(), ref, digest.FromString("manifest"), VerificationPolicy{RequireSignature: false})
+	require.NoError(t, err)
+}
+
+func newFakeSignatureResolver(t *testing.T, ref reference.Named, manifestDigest digest.Digest, key ed25519.PrivateKey) *fakeSignatureResolver {
+	t.Helper()
+
+	var payload signaturePayload
+	payload.Critical.Identity.DockerReference = ref.String()
+	payload.Critical.Image.DockerManifestDigest = manifestDigest.String()
+	payload.Critical.Type = bundleSignatureType
+	payloadBytes, err := json.Marshal(payload)
+	require.NoError(t, err)
+
+	sig := signedBundle{Payload: payloadBytes, Signature: ed25519.Sign(key, payloadBytes)}
+	sigBytes, err := json.Marshal(sig)
+	require.NoError(t, err)
+
+	return &fakeSignatureResolver{
+		desc:     ocispec.Descriptor{Digest: digest.FromBytes(sigBytes), Size: int64(len(sigBytes))},
+		sigBytes: sigBytes,
+	}
+}
+
+func TestVerifyBundleSignature_SucceedsWithTrustedKey(t *testing.T) {
+	r := newTestRegistry(t)
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	ref, err := reference.ParseNormalizedNamed("registry.example.com/mybuns:v0.1.1")
+	require.NoError(t, err)
+	manifestDigest := digest.FromString("manifest")
+
+	resolver := newFakeSignatureResolver(t, ref, manifestDigest, priv)
+	r.newResolver = func(insecureRegistries []string) containerdRemotes.Resolver { return resolver }
+
+	err = r.verifyBundleSignature(context.Background(), ref, manifestDigest, VerificationPolicy{
+		RequireSignature: true,
+		TrustedKeys:      []ed25519.PublicKey{pub},
+	})
+	require.NoError(t, err)
+}
+
+func TestVerifyBundleSignature_FailsWhenUntrustedKey(t *testing.T) {
+	r := newTestRegistry(t)
+
+	_, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	untrustedPub, _, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	ref, err := reference.ParseNormalizedNamed("registry.example.com/mybuns:v0.1.1")
+	require.NoError(t, err)
+	manifestDigest := digest.FromString("manifest")
+
+	resolver := newFakeSignatureResolver(t, ref, manifestDigest, priv)
+	r.newResolver = func(insecureRegistries []string) containerdRemotes.Resolver { return resolver }
+
+	err = r.verifyBundleSignature(context.Background(), ref, manifestDigest, VerificationPolicy{
+		RequireSignature: true,
+		TrustedKeys:      []ed25519.PublicKey{untrustedPub},
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "does not match any trusted key")
+}
+
+func TestVerifyBundleSignature_FailsWhenDigestMismatch(t *testing.T) {
+	r := newTestRegistry(t)
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	ref, err := reference.ParseNormalizedNamed("registry.example.com/mybuns:v0.1.1")
+	require.NoError(t, err)
+
+	resolver := newFakeSignatureResolver(t, ref, digest.FromString("a different manifest"), priv)
+	r.newResolver = func(insecureRegistries []string) containerdRemotes.Resolver { return resolver }
+
+	err = r.verifyBundleSignature(context.Background(), ref, digest.FromString("manifest"), VerificationPolicy{
+		RequireSignature: true,
+		TrustedKeys:      []ed25519.PublicKey{pub},
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "does not match the pulled digest")
+}